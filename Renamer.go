@@ -9,13 +9,22 @@ Author: Gianluca Fiore <forod.g@gmail.com> © 2013-2020
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/afero"
 )
 
 var usageMessage = `
@@ -72,6 +81,57 @@ Arguments:
 
 	-recursive|-r
 		Operate recursively on all subdirectories of target-dir
+
+	-undo <journal>
+		Replay a journal file in reverse, restoring the original
+		names (and removing created copies). No other action flag
+		is needed in this mode
+
+	-rollback-on-error
+		Automatically reverse the operations already applied in
+		the current batch as soon as one operation fails
+
+	-sort <mode>
+		Sort the files before renaming them. <mode> is one of
+		'natural', 'lex', 'mtime', 'size', or one of those with a
+		'-reverse' suffix (e.g. 'natural-reverse'). Mostly useful
+		together with '-index' so that foo-002.jpg is assigned a
+		lower index than foo-010.jpg
+
+	-replace <pattern>
+		A regexp matched against each basename. Requires '-with'
+
+	-with <template>
+		The replacement template applied where '-replace' matched.
+		Supports the usual '$1'/'${name}' capture group syntax plus
+		the tokens '{ext}', '{base}', '{dir}', '{n}' (running
+		index, optionally zero-padded as '{n:04}'),
+		'{mtime:<layout>}' and '{size}'
+
+	-chroot <dir>
+		Sandbox every operation under <dir>, as if it were the root
+		of the filesystem. Useful together with '-dry-run' to
+		rehearse a batch without touching anything outside <dir>
+
+	-include <glob>
+		Only consider files whose path relative to target-dir
+		matches <glob>. Repeatable. Supports '**', brace
+		alternation ('{a,b}') and a leading '!' to negate a glob
+		given earlier
+
+	-exclude <glob>
+		Skip files (and, for directories, their entire subtree)
+		whose path relative to target-dir matches <glob>.
+		Repeatable, same syntax as '-include'
+
+	-ignore-vcs
+		Prune '.git', '.hg' and '.svn' directories, and also honor
+		a '.renamerignore' file (one glob per line, same syntax as
+		'-exclude') found in target-dir
+
+	-jobs <n>
+		Run up to <n> renames/copies concurrently. Default is the
+		number of CPUs available
 `
 
 var regexpArg string         // the regexp argument
@@ -88,9 +148,82 @@ var copyArg bool             // the copy switch
 var dryrunArg bool           // the dry-run switch
 var forceArg bool            // the force switch
 var recursiveArg bool        // the recursive switch
+var undoArg string           // the journal to replay in -undo mode
+var rollbackOnErrorArg bool  // the rollback-on-error switch
+var sortArg string           // the sort mode applied before renaming
+var replaceArg string        // the regexp pattern for -replace
+var withArg string           // the replacement template for -with
+var includeArg stringList    // the -include globs, repeatable
+var excludeArg stringList    // the -exclude globs, repeatable
+var ignoreVCSArg bool        // the -ignore-vcs switch
+
+var operationSuccessful int32 // numeric flag to keep trace of what went
+// wrong during the renaming, incremented atomically since workers
+// touch it concurrently
+
+var jobsArg int // the -jobs worker pool size
+
+var rollingBack int32 // set once -rollback-on-error has started reversing
+// the batch, so concurrent workers stop issuing further ops instead of
+// racing the rollback
+
+// pendingOps counts operations that have journaled their intent but
+// haven't yet finished applying (or failing) the underlying rename/copy.
+// rollingBack only stops workers from *starting* new ops, so
+// triggerRollbackIfRequested waits on this before snapshotting the
+// journal: otherwise it could undo an entry for an op that is still
+// mid-flight on another worker, racing that worker's own rename/copy
+var pendingOps sync.WaitGroup
+
+// JournalEntry records a single rename/copy so it can be undone later
+type JournalEntry struct {
+	OldName string `json:"oldname"`
+	NewName string `json:"newname"`
+	Action  string `json:"action"`
+}
+
+var journalEntries []JournalEntry // entries applied so far in this run
+var journalFile string            // path of the journal file for this run
+
+var chrootArg string // the -chroot sandbox directory
+
+// stringList collects repeated occurrences of the same flag into a
+// slice, e.g. -include "*.jpg" -include "*.png"
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
 
-var operationSuccessful int // numeric flag to keep trace of what went
-// wrong during the renaming
+// vcsDirs are the directories -ignore-vcs prunes by default
+var vcsDirs = map[string]bool{".git": true, ".hg": true, ".svn": true}
+
+// appFs is the filesystem every rename/copy primitive operates
+// against. It defaults to the real OS filesystem, but tests (or
+// -chroot) can point it elsewhere
+var appFs afero.Fs = afero.NewOsFs()
+
+// dirMutexes serializes the Stat-then-Create/Rename sequence in
+// writeFile per target directory, so two workers copying into the
+// same directory can't race each other; workers touching different
+// directories still run fully in parallel
+var dirMutexes sync.Map
+
+func lockTargetDir(path string) func() {
+	mu, _ := dirMutexes.LoadOrStore(filepath.Dir(path), &sync.Mutex{})
+	m := mu.(*sync.Mutex)
+	m.Lock()
+	return m.Unlock
+}
+
+// journalMu guards journalEntries, since workers append to and flush
+// it concurrently
+var journalMu sync.Mutex
 
 // Print a message and the usage instructions
 func printUsage(msg string) {
@@ -148,52 +281,187 @@ func flagsInit() {
 	flag.BoolVar(&forceArg, "f", defForce, "")
 	flag.BoolVar(&recursiveArg, "recursive", defRecursive, "")
 	flag.BoolVar(&recursiveArg, "r", defRecursive, "")
+	flag.StringVar(&undoArg, "undo", "", "")
+	flag.BoolVar(&rollbackOnErrorArg, "rollback-on-error", false, "")
+	flag.StringVar(&sortArg, "sort", "", "")
+	flag.StringVar(&replaceArg, "replace", "", "")
+	flag.StringVar(&withArg, "with", "", "")
+	flag.StringVar(&chrootArg, "chroot", "", "")
+	flag.Var(&includeArg, "include", "")
+	flag.Var(&excludeArg, "exclude", "")
+	flag.BoolVar(&ignoreVCSArg, "ignore-vcs", false, "")
+	flag.IntVar(&jobsArg, "jobs", runtime.NumCPU(), "")
 
 	flag.Parse()
 
-	if regexpArg == "" && prefixArg == "" && suffixArg == "" && indexArg == "" && lowerExtArg == false && lowerArg == false && upperArg == false {
+	if jobsArg < 1 {
+		jobsArg = 1
+	}
+
+	if undoArg != "" {
+		return
+	}
+
+	if regexpArg == "" && prefixArg == "" && suffixArg == "" && indexArg == "" && replaceArg == "" && lowerExtArg == false && lowerArg == false && upperArg == false {
 		printUsage("At least one of the mandatory actions must be given, nothing to do...")
 	}
+
+	if replaceArg != "" && withArg == "" {
+		printUsage("-replace requires -with to specify the replacement template")
+	}
+}
+
+// Write the in-memory journal entries to journalFile, so a crash
+// mid-batch still leaves a usable trail to undo from
+func flushJournal() {
+	if journalFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(journalEntries, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		return
+	}
+	if err := os.WriteFile(journalFile, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+	}
+}
+
+// Record an operation that is about to be applied and flush it to disk
+// before the actual mutation happens
+func appendJournalEntry(oldname, newname, action string) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	journalEntries = append(journalEntries, JournalEntry{OldName: oldname, NewName: newname, Action: action})
+	flushJournal()
+}
+
+// Drop the last recorded entry (used when the mutation it described
+// never actually happened) and flush the correction to disk
+func removeLastJournalEntry() {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if len(journalEntries) == 0 {
+		return
+	}
+	journalEntries = journalEntries[:len(journalEntries)-1]
+	flushJournal()
+}
+
+// Reverse every entry applied so far in this run, most recent first
+func rollbackJournal() {
+	journalMu.Lock()
+	entries := append([]JournalEntry(nil), journalEntries...)
+	journalMu.Unlock()
+	for i := len(entries) - 1; i >= 0; i-- {
+		undoEntry(entries[i])
+	}
+}
+
+// Reverse a single journal entry: remove a created copy, or rename a
+// renamed file back to its original name
+func undoEntry(e JournalEntry) {
+	switch e.Action {
+	case "copy":
+		if rmErr := appFs.Remove(e.NewName); rmErr != nil {
+			fmt.Fprintf(os.Stderr, "Could not remove %s: %s\n", e.NewName, rmErr.Error())
+		} else {
+			fmt.Fprintf(os.Stdout, "Removed %s\n", e.NewName)
+		}
+	case "rename":
+		if rnErr := appFs.Rename(e.NewName, e.OldName); rnErr != nil {
+			fmt.Fprintf(os.Stderr, "Could not restore %s to %s: %s\n", e.NewName, e.OldName, rnErr.Error())
+		} else {
+			fmt.Fprintf(os.Stdout, "Restored %s to %s\n", e.NewName, e.OldName)
+		}
+	}
+}
+
+// Load a journal file and replay its entries in reverse
+func undoFromJournal(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries []JournalEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid journal file %s: %s", path, err.Error())
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		undoEntry(entries[i])
+	}
+	return nil
 }
 
 // Write a renamed or a copy of a file to disk
 func writeFile(oldname, newname string) {
+	unlock := lockTargetDir(newname)
+	defer unlock()
+
 	// check if the new filename is already present
-	_, lstatErr := os.Lstat(newname)
+	_, lstatErr := appFs.Stat(newname)
 	if lstatErr == nil && forceArg == false {
 		fmt.Fprintf(os.Stderr, "File %s already exist! Use -force to override it\n", newname)
-		operationSuccessful = operationSuccessful + 1
+		atomic.AddInt32(&operationSuccessful, 1)
+		if !dryrunArg {
+			// newname isn't part of this batch, so there's nothing
+			// journaled to clean up: just skip the op, and reverse the
+			// batch so far if -rollback-on-error was given
+			triggerRollbackIfRequested()
+			return
+		}
 	}
 	if dryrunArg {
 		// if dry-run was given, just output the renaming operation
 		fmt.Fprintf(os.Stdout, "Renaming %s to %s (dry-run)\n", oldname, newname)
-		operationSuccessful = operationSuccessful + 0
 	} else {
 		if copyArg {
-			copyf, createErr := os.Create(newname)
+			pendingOps.Add(1)
+			appendJournalEntry(oldname, newname, "copy")
+			copyf, createErr := appFs.Create(newname)
 			if createErr != nil {
 				fmt.Fprintf(os.Stderr, createErr.Error())
-				operationSuccessful = operationSuccessful + 1
+				atomic.AddInt32(&operationSuccessful, 1)
+				pendingOps.Done()
+				// Create itself failed: nothing was written, so the
+				// journal entry just appended is already stale
+				failOperation(oldname, newname, "")
+				return
 			}
-			originalf, openErr := os.Open(oldname)
+			originalf, openErr := appFs.Open(oldname)
 			if openErr != nil {
 				fmt.Fprintf(os.Stderr, openErr.Error())
-				operationSuccessful = operationSuccessful + 1
+				atomic.AddInt32(&operationSuccessful, 1)
+				pendingOps.Done()
+				// newname now exists (Create succeeded): clean it up
+				// instead of dropping the journal's only record of it
+				failOperation(oldname, newname, newname)
+				return
 			}
 			_, copyErr := io.Copy(copyf, originalf)
+			pendingOps.Done()
 			if copyErr != nil {
 				fmt.Fprintf(os.Stderr, "An error occurred during the copy of %s to %s\n", oldname, newname)
 				fmt.Fprintf(os.Stderr, copyErr.Error())
-				operationSuccessful = operationSuccessful + 1
+				atomic.AddInt32(&operationSuccessful, 1)
+				// same as above: newname exists, possibly with a
+				// partial copy, and must be removed rather than left
+				// behind with no journal entry to find it by
+				failOperation(oldname, newname, newname)
 			} else {
 				fmt.Fprintf(os.Stdout, "Copying %s to %s\n", oldname, newname)
 			}
 		} else {
-			renameErr := os.Rename(oldname, newname)
+			pendingOps.Add(1)
+			appendJournalEntry(oldname, newname, "rename")
+			renameErr := appFs.Rename(oldname, newname)
+			pendingOps.Done()
 			if renameErr != nil {
 				fmt.Fprintf(os.Stderr, "An error occurred during the renaming of %s to %s\n", oldname, newname)
 				fmt.Fprintf(os.Stderr, renameErr.Error())
-				operationSuccessful = operationSuccessful + 1
+				atomic.AddInt32(&operationSuccessful, 1)
+				// a failed rename leaves nothing at newname
+				failOperation(oldname, newname, "")
 			} else {
 				fmt.Fprintf(os.Stdout, "Renaming %s to %s\n", oldname, newname)
 			}
@@ -201,108 +469,477 @@ func writeFile(oldname, newname string) {
 	}
 }
 
+// failOperation is called right after an operation we just journaled
+// turned out to have failed. partialFile is the path of a file that was
+// actually created on disk despite the overall operation failing (e.g.
+// Create succeeded but the subsequent Open/copy didn't); it is removed
+// before the journal entry is dropped, so neither the filesystem nor
+// the journal is left referencing a file that never completed. Pass ""
+// when nothing was written (Create or Rename itself failed), in which
+// case dropping the entry is all that's needed. Finally, if
+// -rollback-on-error was given, every previously applied operation in
+// this batch is reversed
+func failOperation(oldname, newname, partialFile string) {
+	if partialFile != "" {
+		if rmErr := appFs.Remove(partialFile); rmErr != nil {
+			fmt.Fprintf(os.Stderr, "Could not remove partially-written %s: %s\n", partialFile, rmErr.Error())
+		}
+	}
+	removeLastJournalEntry()
+	triggerRollbackIfRequested()
+}
+
+// triggerRollbackIfRequested reverses every operation applied so far in
+// the current batch and exits, but only the first caller to find
+// rollingBack unset actually does so; concurrent workers racing it
+// just return, having already stopped issuing further ops
+func triggerRollbackIfRequested() {
+	if !rollbackOnErrorArg {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&rollingBack, 0, 1) {
+		return
+	}
+	// runOps's workers only check rollingBack before starting a new op,
+	// so another worker may already be mid-mutation on one it journaled
+	// just before this; wait for it to settle rather than snapshotting
+	// (and undoing) a journal entry whose rename/copy hasn't happened
+	// yet. The caller's own op is never in flight here: writeFile calls
+	// pendingOps.Done() before invoking failOperation/this function
+	pendingOps.Wait()
+	fmt.Fprintf(os.Stderr, "Rolling back already applied operations because of the previous error...\n")
+	rollbackJournal()
+	os.Exit(1)
+}
+
+// renameOp is a single planned rename or copy, old name to new name
+type renameOp struct {
+	Old string
+	New string
+}
+
+// executePlan takes the whole oldname -> newname mapping for a batch,
+// checks it for conflicts and orders it so no file is clobbered before
+// it is itself renamed away, then performs the renames/copies. Two
+// sources mapping to the same target abort the batch unless -force is
+// given. A target that collides with another source still waiting to
+// be renamed is handled by renaming that source first; genuine cycles
+// (a->b, b->a) are broken by routing one of the members through a
+// unique temp name
+func executePlan(files []string, plan map[string]string) int {
+	atomic.StoreInt32(&rollingBack, 0)
+
+	sourceSet := make(map[string]bool, len(files))
+	for _, f := range files {
+		sourceSet[f] = true
+	}
+
+	// (a) two sources mapping to the same target
+	targetCount := make(map[string]int, len(plan))
+	for _, t := range plan {
+		targetCount[t]++
+	}
+	conflict := false
+	for t, c := range targetCount {
+		if c > 1 {
+			fmt.Fprintf(os.Stderr, "Conflict: more than one file would be renamed to %s\n", t)
+			conflict = true
+		}
+	}
+	if conflict && !forceArg {
+		fmt.Fprintf(os.Stderr, "Aborting because of naming conflicts. Use -force to rename anyway\n")
+		atomic.AddInt32(&operationSuccessful, 1)
+		return 1
+	}
+
+	// (b) and (c): order the renames with a DFS over the
+	// old->new graph, white/gray/black colouring to spot cycles.
+	// Every file visited from the same top-level loop iteration below
+	// belongs to one connected component of that graph; its ops start a
+	// new group, or are appended to an earlier group when the chain ends
+	// at a source that group already renames: groups never share a path
+	// (short of -force accepting duplicate targets), so they can be
+	// handed to the worker pool in parallel, but the ops within a group
+	// (notably a cycle's temp-rename/final-rename pair) must run in the
+	// exact order they were generated
+	const white, gray, black = 0, 1, 2
+	color := make(map[string]int, len(files))
+	var ops, finalOps []renameOp
+	var tmpSeq int
+
+	var visit func(f string)
+	visit = func(f string) {
+		if color[f] == black {
+			return
+		}
+		target := plan[f]
+		if target == f {
+			color[f] = black
+			return
+		}
+		if color[f] == gray {
+			// f is still being visited further up the call stack:
+			// we've found a cycle. Break it by routing f through a
+			// unique temp name now, and finishing the real rename
+			// once every other member of the cycle is out of the way
+			tmpSeq++
+			tmp := fmt.Sprintf("%s.renamer-tmp-%d", f, tmpSeq)
+			ops = append(ops, renameOp{f, tmp})
+			finalOps = append(finalOps, renameOp{tmp, plan[f]})
+			color[f] = black
+			return
+		}
+		color[f] = gray
+		if sourceSet[target] {
+			visit(target)
+		}
+		if color[f] == gray {
+			ops = append(ops, renameOp{f, target})
+			color[f] = black
+		}
+	}
+
+	var groups [][]renameOp
+	groupOf := make(map[string]int, len(files))
+	for _, f := range files {
+		before := len(ops) + len(finalOps)
+		visit(f)
+		if len(ops)+len(finalOps) == before {
+			continue
+		}
+		newOps := append(ops, finalOps...)
+		// the first op generated is the end of the chain walked from f:
+		// if its target is a source planned in an earlier iteration, the
+		// chain belongs to that source's group and must run after it
+		g, ok := groupOf[plan[newOps[0].Old]]
+		if !ok {
+			g = len(groups)
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], newOps...)
+		for _, op := range newOps {
+			groupOf[op.Old] = g
+		}
+		ops, finalOps = nil, nil
+	}
+
+	runOps(groups)
+
+	return 0
+}
+
+// runOps executes the given groups of planned rename operations using up
+// to jobsArg worker goroutines. Groups come from distinct connected
+// components of the old->new graph, so they never touch the same path
+// and can run fully concurrently with one another; the ops inside a
+// single group (e.g. a cycle's temp-rename/final-rename pair) are run
+// serially, in the order executePlan generated them, since later ops in
+// the group depend on earlier ones in that group having already run.
+func runOps(groups [][]renameOp) {
+	if len(groups) == 0 {
+		return
+	}
+
+	queue := make(chan []renameOp, len(groups))
+	for _, g := range groups {
+		queue <- g
+	}
+	close(queue)
+
+	workers := jobsArg
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(groups) {
+		workers = len(groups)
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				for _, op := range group {
+					// -rollback-on-error started reversing the batch
+					// on another worker: stop piling on more ops
+					// instead of racing its rollbackJournal snapshot
+					if atomic.LoadInt32(&rollingBack) != 0 {
+						return
+					}
+					writeFile(op.Old, op.New)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 // Add a prefix string to a name
 func addPrefix(names []string, prefix string) int {
-	var finalname, dirname string
+	plan := make(map[string]string, len(names))
 	for _, f := range names {
-		dirname = filepath.Dir(f)
-		finalname = filepath.Join(dirname, prefix+filepath.Base(f))
-		writeFile(f, finalname)
+		dirname := filepath.Dir(f)
+		plan[f] = filepath.Join(dirname, prefix+filepath.Base(f))
 	}
-	return 0
+	return executePlan(names, plan)
 }
 
 // Add a suffix string to a name
 func addSuffix(names []string, suffix string) int {
-	var finalname, dirname, justname, ext string
+	var justname, ext string
+	plan := make(map[string]string, len(names))
 	for _, f := range names {
 		ext = filepath.Ext(f)
-		dirname = filepath.Dir(f)
+		dirname := filepath.Dir(f)
 		justname = strings.TrimSuffix(filepath.Base(f), ext)
-		finalname = filepath.Join(dirname, justname+suffix+ext)
-		writeFile(f, finalname)
+		plan[f] = filepath.Join(dirname, justname+suffix+ext)
 	}
-	return 0
+	return executePlan(names, plan)
 }
 
 // Rename a slice of filenames to <newname><count>.<extension>
 func indexName(names []string, newname string, count int) int {
-	var finalname, dirname, ext string
+	var ext string
+	plan := make(map[string]string, len(names))
 	for _, f := range names {
 		ext = filepath.Ext(f)
-		dirname = filepath.Dir(f)
-		finalname = fmt.Sprintf("%s/%s%03d%s", dirname, newname, count, ext)
-		writeFile(f, finalname)
+		dirname := filepath.Dir(f)
+		plan[f] = fmt.Sprintf("%s/%s%03d%s", dirname, newname, count, ext)
 		count++
 	}
-	return 0
+	return executePlan(names, plan)
 }
 
 // Make extensions lowercase
 func lowercaseExtension(names []string) int {
-	var finalname, dirname, basename, ext string
+	var basename, ext string
+	plan := make(map[string]string, len(names))
 	for _, f := range names {
-		dirname = filepath.Dir(f)
+		dirname := filepath.Dir(f)
 		basename = filepath.Base(f)
 		ext = filepath.Ext(f)
-		finalname = filepath.Join(dirname, strings.TrimSuffix(basename, ext)+strings.ToLower(strings.TrimSuffix(ext, basename)))
-		writeFile(f, finalname)
+		plan[f] = filepath.Join(dirname, strings.TrimSuffix(basename, ext)+strings.ToLower(strings.TrimSuffix(ext, basename)))
 	}
-	return 0
+	return executePlan(names, plan)
 }
 
 // Make filenames all lowercase
 func lowercaseFiles(names []string) int {
-	var finalname, dirname string
+	plan := make(map[string]string, len(names))
 	for _, f := range names {
-		dirname = filepath.Dir(f)
-		finalname = filepath.Join(dirname, strings.ToLower(filepath.Base(f)))
-		writeFile(f, finalname)
+		dirname := filepath.Dir(f)
+		plan[f] = filepath.Join(dirname, strings.ToLower(filepath.Base(f)))
 	}
-	return 0
+	return executePlan(names, plan)
 }
 
 // Make filenames all uppercase
 func uppercaseFiles(names []string) int {
-	var finalname, dirname string
+	plan := make(map[string]string, len(names))
 	for _, f := range names {
-		dirname = filepath.Dir(f)
-		finalname = filepath.Join(dirname, strings.ToUpper(filepath.Base(f)))
-		writeFile(f, finalname)
+		dirname := filepath.Dir(f)
+		plan[f] = filepath.Join(dirname, strings.ToUpper(filepath.Base(f)))
 	}
-	return 0
+	return executePlan(names, plan)
+}
+
+var templateTokenRegexp = regexp.MustCompile(`\{ext\}|\{base\}|\{dir\}|\{size\}|\{n(?::(\d+))?\}|\{mtime:([^}]*)\}`)
+
+// Expand the {ext}/{base}/{dir}/{n}/{n:04}/{mtime:<layout>}/{size}
+// tokens in tmpl for a single file, leaving any $1/${name} capture
+// group syntax untouched for the caller's regexp to expand
+func expandTemplateTokens(tmpl, f string, n int) string {
+	dirname := filepath.Dir(f)
+	basename := filepath.Base(f)
+	ext := filepath.Ext(f)
+	justname := strings.TrimSuffix(basename, ext)
+
+	var mtime time.Time
+	var size int64
+	if info, err := appFs.Stat(f); err == nil {
+		mtime = info.ModTime()
+		size = info.Size()
+	}
+
+	return templateTokenRegexp.ReplaceAllStringFunc(tmpl, func(tok string) string {
+		groups := templateTokenRegexp.FindStringSubmatch(tok)
+		switch {
+		case tok == "{ext}":
+			return ext
+		case tok == "{base}":
+			return justname
+		case tok == "{dir}":
+			return dirname
+		case tok == "{size}":
+			return strconv.FormatInt(size, 10)
+		case strings.HasPrefix(tok, "{n"):
+			if groups[1] == "" {
+				return strconv.Itoa(n)
+			}
+			width, _ := strconv.Atoi(groups[1])
+			return fmt.Sprintf("%0*d", width, n)
+		case strings.HasPrefix(tok, "{mtime:"):
+			return mtime.Format(groups[2])
+		}
+		return tok
+	})
+}
+
+// Rewrite each basename matching pat with tmpl, expanding both the
+// regexp's own $1/${name} capture groups and the {ext}/{base}/{dir}/
+// {n}/{mtime:...}/{size} tokens
+func replaceName(names []string, pat, tmpl string) int {
+	compPat, err := regexp.Compile(pat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid regexp: %s\n", pat)
+		printUsage("You must give a valid regexp for -replace")
+		return 1
+	}
+
+	plan := make(map[string]string, len(names))
+	for idx, f := range names {
+		dirname := filepath.Dir(f)
+		basename := filepath.Base(f)
+		expanded := expandTemplateTokens(tmpl, f, numArg+idx)
+		plan[f] = filepath.Join(dirname, compPat.ReplaceAllString(basename, expanded))
+	}
+	return executePlan(names, plan)
+}
+
+// Split a basename into alternating runs of digits and non-digits, e.g.
+// "img10b" -> ["img", "10", "b"]
+func splitDigitRuns(s string) []string {
+	var runs []string
+	if s == "" {
+		return runs
+	}
+	isDigit := func(b byte) bool { return b >= '0' && b <= '9' }
+	start := 0
+	curDigit := isDigit(s[0])
+	for i := 1; i < len(s); i++ {
+		d := isDigit(s[i])
+		if d != curDigit {
+			runs = append(runs, s[start:i])
+			start = i
+			curDigit = d
+		}
+	}
+	return append(runs, s[start:])
+}
+
+// Compare two digit runs numerically: strip leading zeros, then
+// compare by length and, if equal, lexically
+func compareDigitRun(a, b string) int {
+	ta := strings.TrimLeft(a, "0")
+	tb := strings.TrimLeft(b, "0")
+	if len(ta) != len(tb) {
+		if len(ta) < len(tb) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(ta, tb)
+}
+
+// Natural-order comparison of two basenames, so that "a2" < "a10" <
+// "a10b"
+func naturalCompare(a, b string) int {
+	ra := splitDigitRuns(a)
+	rb := splitDigitRuns(b)
+	for i := 0; i < len(ra) && i < len(rb); i++ {
+		ca, cb := ra[i], rb[i]
+		aDigit := len(ca) > 0 && ca[0] >= '0' && ca[0] <= '9'
+		bDigit := len(cb) > 0 && cb[0] >= '0' && cb[0] <= '9'
+		var c int
+		if aDigit && bDigit {
+			c = compareDigitRun(ca, cb)
+		} else {
+			c = strings.Compare(ca, cb)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return len(ra) - len(rb)
+}
+
+// Sort a slice of paths according to mode ('natural', 'lex', 'mtime',
+// 'size', optionally suffixed with '-reverse'), returning a new slice.
+// An empty or unknown mode returns names itself, unsorted
+func sortFiles(names []string, mode string) []string {
+	if mode == "" {
+		return names
+	}
+
+	reverse := strings.HasSuffix(mode, "-reverse")
+	base := strings.TrimSuffix(mode, "-reverse")
+
+	sorted := make([]string, len(names))
+	copy(sorted, names)
+
+	switch base {
+	case "natural":
+		sort.Slice(sorted, func(i, j int) bool {
+			return naturalCompare(filepath.Base(sorted[i]), filepath.Base(sorted[j])) < 0
+		})
+	case "lex":
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i] < sorted[j]
+		})
+	case "mtime":
+		sort.Slice(sorted, func(i, j int) bool {
+			si, ierr := appFs.Stat(sorted[i])
+			sj, jerr := appFs.Stat(sorted[j])
+			if ierr != nil || jerr != nil {
+				return false
+			}
+			return si.ModTime().Before(sj.ModTime())
+		})
+	case "size":
+		sort.Slice(sorted, func(i, j int) bool {
+			si, ierr := appFs.Stat(sorted[i])
+			sj, jerr := appFs.Stat(sorted[j])
+			if ierr != nil || jerr != nil {
+				return false
+			}
+			return si.Size() < sj.Size()
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown sort mode %s, ignoring -sort\n", mode)
+		return names
+	}
+
+	if reverse {
+		for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+			sorted[i], sorted[j] = sorted[j], sorted[i]
+		}
+	}
+
+	return sorted
 }
 
 // Get all files and directories
 func getFilesFromDir(dirname string) ([]string, []string) {
-	var completePath string                // final, absolute, path
 	var filesindir = make([]os.FileInfo, 0) // files & directories found in path
 	var allfiles = make([]string, 0)
 	var alldirectories = make([]string, 0)
 
-	dirinfo, lerr := os.Lstat(dirname)
-	if lerr != nil {
+	if _, lerr := appFs.Stat(dirname); lerr != nil {
 		fmt.Fprintf(os.Stderr, lerr.Error())
 		return alldirectories, allfiles
 	}
 
-	// check whether targetArg is an absolute path AND a directory
-	if filepath.IsAbs(dirname) && dirinfo.IsDir() {
-		completePath = dirname
-	} else {
-		absPath, err := filepath.Abs(dirname)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error())
-		}
-		completePath = absPath
-	}
-	dir, err := os.Open(completePath)
-	defer dir.Close()
+	// dirname is resolved against appFs as-is, same as walkDir/walkTree:
+	// calling filepath.Abs here would resolve against the real OS cwd,
+	// which double-prefixes the chroot dir once appFs is a BasePathFs
+	completePath := dirname
+	dir, err := appFs.Open(completePath)
 	if err != nil {
 		err = fmt.Errorf("Target directory %s is not a directory or can't be accessed\n", completePath)
 		fmt.Fprintf(os.Stderr, err.Error())
 		return alldirectories, allfiles
 	}
+	defer dir.Close()
 
 	// scan for files/directories in path
 	filesindir, readErr := dir.Readdir(0)
@@ -324,6 +961,203 @@ func getFilesFromDir(dirname string) ([]string, []string) {
 	return alldirectories, allfiles
 }
 
+// globPattern is a compiled -include/-exclude glob, plus whether it
+// was given with a leading '!' to negate a previous match
+type globPattern struct {
+	negate bool
+	re     *regexp.Regexp
+}
+
+// compileGlobPatterns compiles a list of raw -include/-exclude globs,
+// each optionally prefixed with '!' to negate it
+func compileGlobPatterns(raws []string) ([]globPattern, error) {
+	patterns := make([]globPattern, 0, len(raws))
+	for _, raw := range raws {
+		negate := strings.HasPrefix(raw, "!")
+		re, err := globToRegexp(strings.TrimPrefix(raw, "!"))
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, globPattern{negate: negate, re: re})
+	}
+	return patterns, nil
+}
+
+// globToRegexp translates a glob pattern into an anchored regexp.
+// '*' matches within a single path segment, '**' matches zero or more
+// whole segments, '?' matches a single non-separator rune, and
+// '{a,b,...}' matches any one of the given alternatives
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	segments := strings.Split(pattern, "/")
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		if seg == "**" {
+			if last {
+				sb.WriteString(".*")
+			} else {
+				sb.WriteString(`(?:[^/]+/)*`)
+			}
+			continue
+		}
+		segRe, err := globSegmentToRegexp(seg)
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString(segRe)
+		if !last {
+			sb.WriteString("/")
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// globSegmentToRegexp translates the glob syntax within a single path
+// segment (no '/' involved) into a regexp fragment
+func globSegmentToRegexp(seg string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(seg); i++ {
+		switch c := seg[i]; c {
+		case '*':
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '{':
+			end := strings.IndexByte(seg[i:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("unterminated { in pattern %q", seg)
+			}
+			end += i
+			alts := strings.Split(seg[i+1:end], ",")
+			sb.WriteString("(?:")
+			for j, alt := range alts {
+				if j > 0 {
+					sb.WriteString("|")
+				}
+				sb.WriteString(regexp.QuoteMeta(alt))
+			}
+			sb.WriteString(")")
+			i = end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String(), nil
+}
+
+// matchGlobs reports whether any pattern matches relpath, and, if so,
+// whether the last matching pattern was a plain glob (true) or one
+// negated with a leading '!' (false) - gitignore style, last match
+// wins
+func matchGlobs(patterns []globPattern, relpath string) (matched, plain bool) {
+	for _, p := range patterns {
+		if p.re.MatchString(relpath) {
+			matched = true
+			plain = !p.negate
+		}
+	}
+	return matched, plain
+}
+
+// pathAllowed applies -include then -exclude semantics to a path
+// relative to target-dir: a plain -include match keeps it, a
+// '!'-negated one drops it; symmetrically a plain -exclude match
+// drops it and a '!'-negated one keeps it despite an earlier match
+func pathAllowed(relpath string, includes, excludes []globPattern) bool {
+	allowed := true
+	if len(includes) > 0 {
+		allowed = false
+		if matched, plain := matchGlobs(includes, relpath); matched {
+			allowed = plain
+		}
+	}
+	if !allowed {
+		return false
+	}
+	if matched, plain := matchGlobs(excludes, relpath); matched && plain {
+		allowed = false
+	} else if matched {
+		allowed = true
+	}
+	return allowed
+}
+
+// loadIgnoreFile reads a .renamerignore file (one glob per line,
+// blank lines and '#' comments skipped) if one exists directly under
+// root
+func loadIgnoreFile(root string) []string {
+	data, err := afero.ReadFile(appFs, filepath.Join(root, ".renamerignore"))
+	if err != nil {
+		return nil
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// walkTree streams the files under root (optionally recursing into
+// subdirectories), applying -include/-exclude filtering and, when
+// ignoreVCS is set, pruning VCS directories. A directory rejected by
+// the filters is never descended into
+func walkTree(root string, includes, excludes []globPattern, recurse, ignoreVCS bool) []string {
+	var files []string
+	walkDir(root, root, includes, excludes, recurse, ignoreVCS, &files)
+	return files
+}
+
+func walkDir(root, dir string, includes, excludes []globPattern, recurse, ignoreVCS bool, files *[]string) {
+	f, err := appFs.Open(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		return
+	}
+	entries, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		return
+	}
+
+	for _, entry := range entries {
+		full := filepath.Join(dir, entry.Name())
+		rel, err := filepath.Rel(root, full)
+		if err != nil {
+			rel = full
+		}
+		rel = filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if ignoreVCS && vcsDirs[entry.Name()] {
+				continue
+			}
+			// -include only filters which files end up in the
+			// result; a directory is pruned only if -exclude (or
+			// .renamerignore) explicitly rejects it, otherwise it
+			// still needs to be walked to reach matching files below
+			if matched, plain := matchGlobs(excludes, rel); matched && plain {
+				continue
+			}
+			if recurse {
+				walkDir(root, full, includes, excludes, recurse, ignoreVCS, files)
+			}
+			continue
+		}
+
+		if !pathAllowed(rel, includes, excludes) {
+			continue
+		}
+		*files = append(*files, full)
+	}
+}
+
 func renameFiles(dir, files []string) int {
 	var basename string
 	var matchingfiles []string // a slice containing only the files
@@ -331,24 +1165,27 @@ func renameFiles(dir, files []string) int {
 	var result int // the integer returned by each functions,
 	// signaling success or failure
 
-	// recursively search on every directory in dir for other
-	// files/directories if recursiveArg switch has been enabled
-	if dir != nil && recursiveArg == true {
-		for _, d := range dir {
-			nd, nf := getFilesFromDir(d)
-			// if it's a dir, append to []dir
-			if len(nd) > 0 {
-				for _, i := range nd {
-					dir = append(dir, i)
-				}
-			}
-			// if it's a file, append to []files
-			if len(nf) > 0 {
-				for _, i := range nf {
-					files = append(files, i)
-				}
-			}
-		}
+	excludePatterns := []string(excludeArg)
+	if ignoreVCSArg {
+		excludePatterns = append(excludePatterns, loadIgnoreFile(targetArg)...)
+	}
+	includes, incErr := compileGlobPatterns(includeArg)
+	excludes, excErr := compileGlobPatterns(excludePatterns)
+	if incErr != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -include pattern: %s\n", incErr.Error())
+		return 1
+	}
+	if excErr != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -exclude pattern: %s\n", excErr.Error())
+		return 1
+	}
+
+	// re-walk the whole tree with the filters applied: a directory
+	// rejected by -exclude/-ignore-vcs is never recursed
+	// into, and recursion (when requested) now actually descends all
+	// the way down instead of a single extra level
+	if len(includes) > 0 || len(excludes) > 0 || recursiveArg {
+		files = walkTree(targetArg, includes, excludes, recursiveArg, ignoreVCSArg)
 	}
 
 	// check if the files should match a given regexp
@@ -361,13 +1198,13 @@ func renameFiles(dir, files []string) int {
 				fmt.Fprintf(os.Stderr, "Invalid regexp: %s\n", regexpArg)
 				printUsage("You must give a valid regexp (or none, to operate on all files). Alternatively, add -force to force renaming all files, whether they match the regexp or not")
 				return 1
+			}
 
 			if compRegexp.MatchString(basename) == false {
 				continue
 			} else {
 				matchingfiles = append(matchingfiles, f)
 			}
-			}
 		}
 	}
 
@@ -387,6 +1224,10 @@ func renameFiles(dir, files []string) int {
 		}
 	}
 
+	if sortArg != "" {
+		files = sortFiles(files, sortArg)
+	}
+
 	if prefixArg != "" {
 		result = addPrefix(files, prefixArg)
 	}
@@ -396,6 +1237,9 @@ func renameFiles(dir, files []string) int {
 	if indexArg != "" {
 		result = indexName(files, indexArg, numArg)
 	}
+	if replaceArg != "" {
+		result = replaceName(files, replaceArg, withArg)
+	}
 	if lowerArg == true && upperArg == true {
 		// can't use both
 		printUsage("Can't use both lowercase and uppercase, choose one only!")
@@ -420,6 +1264,26 @@ func main() {
 
 	flagsInit()
 
+	if chrootArg != "" {
+		appFs = afero.NewBasePathFs(afero.NewOsFs(), chrootArg)
+	}
+
+	if undoArg != "" {
+		if err := undoFromJournal(undoArg); err != nil {
+			fmt.Fprintf(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "\nUndo complete\n")
+		return
+	}
+
+	// pid+nanosecond timestamp, not just a unix-second timestamp: two
+	// invocations started within the same second (e.g. a script looping
+	// over several target directories) would otherwise clobber each
+	// other's journal file and lose the undo trail for whichever wrote
+	// first
+	journalFile = fmt.Sprintf(".renamer-journal-%d-%d.json", os.Getpid(), time.Now().UnixNano())
+
 	directories, files = getFilesFromDir(targetArg)
 
 	successRename = renameFiles(directories, files)
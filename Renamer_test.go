@@ -0,0 +1,616 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// resetGlobals restores the package-level flag vars to a known-empty
+// state and swaps in a fresh MemMapFs, returning a func to put the real
+// OS filesystem back. Tests that touch flags/appFs should defer it
+func resetGlobals(t *testing.T) func() {
+	t.Helper()
+	prevFs := appFs
+	prevForce := forceArg
+	prevCopy := copyArg
+	prevDryrun := dryrunArg
+	prevJobs := jobsArg
+	prevOpSuccessful := operationSuccessful
+	prevRollingBack := rollingBack
+	prevRollbackOnError := rollbackOnErrorArg
+	prevJournalEntries := journalEntries
+	prevJournalFile := journalFile
+	prevNumArg := numArg
+
+	appFs = afero.NewMemMapFs()
+	forceArg = false
+	copyArg = false
+	dryrunArg = false
+	jobsArg = 4
+	operationSuccessful = 0
+	rollingBack = 0
+	rollbackOnErrorArg = false
+	journalEntries = nil
+	journalFile = ""
+	numArg = 1
+
+	return func() {
+		appFs = prevFs
+		forceArg = prevForce
+		copyArg = prevCopy
+		dryrunArg = prevDryrun
+		jobsArg = prevJobs
+		operationSuccessful = prevOpSuccessful
+		rollingBack = prevRollingBack
+		rollbackOnErrorArg = prevRollbackOnError
+		journalEntries = prevJournalEntries
+		journalFile = prevJournalFile
+		numArg = prevNumArg
+	}
+}
+
+// TestExecutePlanBreaksCycle is a regression test for a two-file swap
+// (a<->b), the exact shape of plan that makes executePlan route one of
+// the files through a temp name. runOps used to deadlock on the dependency
+// cycle this produces, so the whole call is bounded by a timeout: a
+// reintroduced deadlock fails the test instead of hanging the suite
+func TestExecutePlanBreaksCycle(t *testing.T) {
+	defer resetGlobals(t)()
+
+	if err := afero.WriteFile(appFs, "a", []byte("contents-of-a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(appFs, "b", []byte("contents-of-b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := map[string]string{"a": "b", "b": "a"}
+	files := []string{"a", "b"}
+
+	done := make(chan int, 1)
+	go func() { done <- executePlan(files, plan) }()
+
+	select {
+	case result := <-done:
+		if result != 0 {
+			t.Fatalf("executePlan returned %d, want 0", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("executePlan did not return - worker pool deadlocked on the rename cycle")
+	}
+
+	aContents, err := afero.ReadFile(appFs, "a")
+	if err != nil {
+		t.Fatalf("reading a after swap: %v", err)
+	}
+	bContents, err := afero.ReadFile(appFs, "b")
+	if err != nil {
+		t.Fatalf("reading b after swap: %v", err)
+	}
+	if string(aContents) != "contents-of-b" {
+		t.Errorf("a = %q, want contents-of-b", aContents)
+	}
+	if string(bContents) != "contents-of-a" {
+		t.Errorf("b = %q, want contents-of-a", bContents)
+	}
+}
+
+// TestExecutePlanConflictAborts checks that two sources mapping to the
+// same target is rejected without -force
+func TestExecutePlanConflictAborts(t *testing.T) {
+	defer resetGlobals(t)()
+
+	for _, name := range []string{"x", "y"} {
+		if err := afero.WriteFile(appFs, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan := map[string]string{"x": "z", "y": "z"}
+	result := executePlan([]string{"x", "y"}, plan)
+	if result != 1 {
+		t.Fatalf("executePlan returned %d, want 1 (conflict)", result)
+	}
+	if exists, _ := afero.Exists(appFs, "z"); exists {
+		t.Error("z should not have been created when the plan conflicted")
+	}
+}
+
+// TestWriteFileNoPanicOnCreateError is a regression test: appFs.Create
+// returning a bare nil interface on error used to make the subsequent
+// io.Copy nil-dereference. A read-only filesystem reproduces the same
+// Create failure a permission-denied directory would
+func TestWriteFileNoPanicOnCreateError(t *testing.T) {
+	defer resetGlobals(t)()
+	copyArg = true
+
+	base := afero.NewMemMapFs()
+	if err := afero.WriteFile(base, "old", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	appFs = afero.NewReadOnlyFs(base)
+
+	writeFile("old", "new")
+	// reaching this line without a SIGSEGV is the assertion
+}
+
+// TestWriteFileNoPanicOnOpenError exercises the other half: Create
+// succeeds but the source file doesn't exist, so Open fails
+func TestWriteFileNoPanicOnOpenError(t *testing.T) {
+	defer resetGlobals(t)()
+	copyArg = true
+
+	writeFile("missing-source", "new")
+}
+
+// TestGetFilesFromDirMissingDir is a regression test: getFilesFromDir
+// used to defer dir.Close() before checking the error from appFs.Open,
+// panicking on a nil dir when the directory couldn't be accessed
+func TestGetFilesFromDirMissingDir(t *testing.T) {
+	defer resetGlobals(t)()
+
+	dirs, files := getFilesFromDir("/does/not/exist")
+	if len(dirs) != 0 || len(files) != 0 {
+		t.Errorf("got dirs=%v files=%v, want both empty", dirs, files)
+	}
+}
+
+// TestGetFilesFromDirUnderBasePathFs is a regression test: getFilesFromDir
+// used to resolve a relative dirname (e.g. the default target ".") via
+// filepath.Abs against the real OS cwd before handing it to appFs, which
+// double-prefixed the sandbox root once appFs was a BasePathFs (-chroot)
+// and made the default, non-recursive invocation unable to see anything
+func TestGetFilesFromDirUnderBasePathFs(t *testing.T) {
+	defer resetGlobals(t)()
+
+	base := afero.NewMemMapFs()
+	if err := afero.WriteFile(base, "/sandbox/one", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := base.MkdirAll("/sandbox/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	appFs = afero.NewBasePathFs(base, "/sandbox")
+
+	dirs, files := getFilesFromDir(".")
+	if len(files) != 1 || files[0] != "one" {
+		t.Errorf("got files=%v, want [one]", files)
+	}
+	if len(dirs) != 1 || dirs[0] != "sub" {
+		t.Errorf("got dirs=%v, want [sub]", dirs)
+	}
+}
+
+// TestSortFilesUsesAppFs is a regression test for -sort mtime/size
+// statting the real OS filesystem instead of appFs, which meant
+// -chroot didn't sandbox them and they couldn't be driven against a
+// MemMapFs at all
+func TestSortFilesUsesAppFs(t *testing.T) {
+	defer resetGlobals(t)()
+
+	if err := afero.WriteFile(appFs, "big", make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(appFs, "small", make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sorted := sortFiles([]string{"big", "small"}, "size")
+	if len(sorted) != 2 || sorted[0] != "small" || sorted[1] != "big" {
+		t.Errorf("sortFiles(size) = %v, want [small big]", sorted)
+	}
+}
+
+func TestNaturalCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"file2", "file10", -1},
+		{"file10", "file2", 1},
+		{"file2", "file2", 0},
+		{"a", "b", -1},
+	}
+	for _, c := range cases {
+		got := naturalCompare(c.a, c.b)
+		if sign(got) != c.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want sign %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func TestPathAllowedGlobs(t *testing.T) {
+	includes, err := compileGlobPatterns([]string{"*.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := compileGlobPatterns([]string{"vendor/**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"main.go", true},
+		{"README.md", false},
+		{"vendor/lib.go", false},
+	}
+	for _, c := range cases {
+		if got := pathAllowed(c.path, includes, excludes); got != c.want {
+			t.Errorf("pathAllowed(%q) = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
+
+// TestWriteFileDoesNotClobberExisting is a regression test: the
+// existing-file check only used to print a warning and bump
+// operationSuccessful, falling through to Create/Rename regardless, so
+// a target that already existed on disk (but wasn't itself part of the
+// batch) got silently overwritten anyway
+func TestWriteFileDoesNotClobberExisting(t *testing.T) {
+	defer resetGlobals(t)()
+
+	if err := afero.WriteFile(appFs, "old", []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(appFs, "new", []byte("pre-existing contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile("old", "new")
+
+	newContents, err := afero.ReadFile(appFs, "new")
+	if err != nil {
+		t.Fatalf("reading new: %v", err)
+	}
+	if string(newContents) != "pre-existing contents" {
+		t.Errorf("new = %q, want untouched pre-existing contents", newContents)
+	}
+	if exists, _ := afero.Exists(appFs, "old"); !exists {
+		t.Error("old should still exist, writeFile must not have renamed over the existing target")
+	}
+	if operationSuccessful == 0 {
+		t.Error("operationSuccessful should have been incremented")
+	}
+}
+
+// TestWriteFileCleansUpPartialCopyOnOpenFailure is a regression test
+// for chunk0-1: failOperation used to unconditionally drop the journal
+// entry appended just before Create, even when Create had actually
+// succeeded and left a real file on disk (because the later Open of
+// the source failed). That orphaned the created file with no journal
+// entry left to undo/rollback it
+func TestWriteFileCleansUpPartialCopyOnOpenFailure(t *testing.T) {
+	defer resetGlobals(t)()
+	copyArg = true
+
+	writeFile("missing-source", "new")
+
+	if exists, _ := afero.Exists(appFs, "new"); exists {
+		t.Error("the partially-created new should have been removed")
+	}
+	if len(journalEntries) != 0 {
+		t.Errorf("journalEntries = %v, want empty now that the partial file was cleaned up", journalEntries)
+	}
+}
+
+// TestRollbackJournalRestoresRenamesAndCopies exercises the journal
+// subsystem end to end: a rename and a copy are journaled and applied
+// against a MemMapFs, then rollbackJournal must put the filesystem
+// back the way it was
+func TestRollbackJournalRestoresRenamesAndCopies(t *testing.T) {
+	defer resetGlobals(t)()
+
+	if err := afero.WriteFile(appFs, "a", []byte("a-contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	appendJournalEntry("a", "b", "rename")
+	if err := appFs.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := afero.WriteFile(appFs, "c", []byte("c-contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	appendJournalEntry("c", "c-copy", "copy")
+	if err := afero.WriteFile(appFs, "c-copy", []byte("c-contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rollbackJournal()
+
+	if exists, _ := afero.Exists(appFs, "a"); !exists {
+		t.Error("a should have been restored by the rollback")
+	}
+	if exists, _ := afero.Exists(appFs, "b"); exists {
+		t.Error("b should no longer exist after the rollback")
+	}
+	if exists, _ := afero.Exists(appFs, "c-copy"); exists {
+		t.Error("c-copy should have been removed by the rollback")
+	}
+}
+
+// TestUndoFromJournalRestoresOriginalNames drives undoFromJournal end
+// to end. The journal file itself is always read/written against the
+// real OS filesystem (so it survives a -chroot sandbox), so this test
+// uses a real temp directory rather than appFs's MemMapFs
+func TestUndoFromJournalRestoresOriginalNames(t *testing.T) {
+	defer resetGlobals(t)()
+	appFs = afero.NewOsFs()
+
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "original.txt")
+	newPath := filepath.Join(dir, "renamed.txt")
+	if err := os.WriteFile(oldPath, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+
+	journalPath := filepath.Join(dir, "journal.json")
+	journalEntries = []JournalEntry{{OldName: oldPath, NewName: newPath, Action: "rename"}}
+	journalFile = journalPath
+	flushJournal()
+
+	if err := undoFromJournal(journalPath); err != nil {
+		t.Fatalf("undoFromJournal: %v", err)
+	}
+
+	if _, err := os.Stat(oldPath); err != nil {
+		t.Errorf("original.txt should have been restored: %v", err)
+	}
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		t.Errorf("renamed.txt should no longer exist, stat err = %v", err)
+	}
+}
+
+// TestRunOpsStopsWorkersOnceRollingBack is a regression test for
+// chunk0-7: runOps workers used to keep draining the queue and calling
+// writeFile (and appending journal entries) even after another worker
+// had set rollingBack, so a concurrent -rollback-on-error snapshot of
+// journalEntries could race ops still being applied. Pre-setting
+// rollingBack before runOps starts must make every worker return
+// immediately without touching the filesystem or the journal
+func TestRunOpsStopsWorkersOnceRollingBack(t *testing.T) {
+	defer resetGlobals(t)()
+	jobsArg = 8
+	atomic.StoreInt32(&rollingBack, 1)
+
+	const n = 20
+	groups := make([][]renameOp, n)
+	for i := 0; i < n; i++ {
+		old := filepath.Join("/", "file"+strconv.Itoa(i))
+		new := filepath.Join("/", "renamed"+strconv.Itoa(i))
+		if err := afero.WriteFile(appFs, old, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		groups[i] = []renameOp{{Old: old, New: new}}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		runOps(groups)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runOps did not return")
+	}
+
+	for i := 0; i < n; i++ {
+		old := filepath.Join("/", "file"+strconv.Itoa(i))
+		if exists, _ := afero.Exists(appFs, old); !exists {
+			t.Errorf("%s should not have been touched once rollingBack was set", old)
+		}
+	}
+	if len(journalEntries) != 0 {
+		t.Errorf("journalEntries = %v, want empty: no op should have run once rollingBack was set", journalEntries)
+	}
+}
+
+// TestWriteFileDoesNotLeakPendingOps is a regression test for the
+// pendingOps counter added alongside rollingBack: triggerRollbackIfRequested
+// waits on it before snapshotting the journal, so every path through
+// writeFile's rename/copy branches (success or failure) must pair its
+// pendingOps.Add(1) with a pendingOps.Done() or a later
+// -rollback-on-error run would hang in pendingOps.Wait() forever
+func TestWriteFileDoesNotLeakPendingOps(t *testing.T) {
+	defer resetGlobals(t)()
+
+	if err := afero.WriteFile(appFs, "old", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("old", "new")     // succeeds
+	writeFile("missing", "new2") // fails: source doesn't exist
+
+	done := make(chan struct{})
+	go func() {
+		pendingOps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pendingOps never drained - writeFile leaked an Add(1) without a matching Done()")
+	}
+}
+
+// TestSortFilesReverseAndUnknownMode covers the dispatch in sortFiles
+// beyond plain natural/mtime/size: the '-reverse' suffix and falling
+// back to the unsorted input on an unrecognized mode
+func TestSortFilesReverseAndUnknownMode(t *testing.T) {
+	names := []string{"b", "a", "c"}
+
+	sorted := sortFiles(names, "lex-reverse")
+	if len(sorted) != 3 || sorted[0] != "c" || sorted[1] != "b" || sorted[2] != "a" {
+		t.Errorf("sortFiles(lex-reverse) = %v, want [c b a]", sorted)
+	}
+
+	fallback := sortFiles(names, "bogus-mode")
+	if len(fallback) != len(names) {
+		t.Fatalf("sortFiles(bogus-mode) = %v, want the original slice back", fallback)
+	}
+	for i := range names {
+		if fallback[i] != names[i] {
+			t.Errorf("sortFiles(bogus-mode)[%d] = %q, want %q (unsorted passthrough)", i, fallback[i], names[i])
+		}
+	}
+}
+
+// TestExpandTemplateTokens covers the token substitutions -replace/-with
+// supports: {ext}/{base}, the zero-padded running index, and the
+// size/mtime tokens, which need appFs.Stat to resolve
+func TestExpandTemplateTokens(t *testing.T) {
+	defer resetGlobals(t)()
+
+	mtime := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	if err := afero.WriteFile(appFs, "/dir/photo.JPG", make([]byte, 42), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := appFs.Chtimes("/dir/photo.JPG", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	got := expandTemplateTokens("{base}{ext}-{n:04}-{size}-{mtime:2006-01-02}", "/dir/photo.JPG", 7)
+	want := "photo.JPG-0007-42-2024-03-05"
+	if got != want {
+		t.Errorf("expandTemplateTokens = %q, want %q", got, want)
+	}
+}
+
+// TestReplaceNameAppliesCaptureGroupsAndTemplate exercises -replace end
+// to end: the regexp's own capture groups and the {n} token both
+// expand in the same -with template
+func TestReplaceNameAppliesCaptureGroupsAndTemplate(t *testing.T) {
+	defer resetGlobals(t)()
+	numArg = 1
+
+	for _, f := range []string{"/img_a.txt", "/img_b.txt"} {
+		if err := afero.WriteFile(appFs, f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := replaceName([]string{"/img_a.txt", "/img_b.txt"}, `img_(\w)\.txt`, "photo-$1-{n}.txt")
+	if result != 0 {
+		t.Fatalf("replaceName returned %d, want 0", result)
+	}
+	if exists, _ := afero.Exists(appFs, "/photo-a-1.txt"); !exists {
+		t.Error("expected /photo-a-1.txt to exist")
+	}
+	if exists, _ := afero.Exists(appFs, "/photo-b-2.txt"); !exists {
+		t.Error("expected /photo-b-2.txt to exist")
+	}
+}
+
+// TestWalkTreeIncludeExclude exercises the actual recursive walker,
+// not just the lower-level glob-matching helpers: -include should keep
+// only matching files, -exclude should prune whole subtrees, and a
+// non-recursive walk should not descend at all
+func TestWalkTreeIncludeExclude(t *testing.T) {
+	defer resetGlobals(t)()
+
+	for _, f := range []string{
+		"/root/a.go",
+		"/root/b.md",
+		"/root/sub/c.go",
+		"/root/vendor/d.go",
+	} {
+		if err := afero.WriteFile(appFs, f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	includes, err := compileGlobPatterns([]string{"**/*.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := compileGlobPatterns([]string{"vendor/**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := walkTree("/root", includes, excludes, true, false)
+	want := map[string]bool{"/root/a.go": true, "/root/sub/c.go": true}
+	if len(got) != len(want) {
+		t.Fatalf("walkTree recursive = %v, want exactly %v", got, want)
+	}
+	for _, f := range got {
+		if !want[f] {
+			t.Errorf("walkTree returned unexpected file %s", f)
+		}
+	}
+
+	nonRecursive := walkTree("/root", nil, nil, false, false)
+	for _, f := range nonRecursive {
+		if f == "/root/sub/c.go" {
+			t.Error("non-recursive walk should not have descended into sub/")
+		}
+	}
+}
+
+// TestWalkTreeIgnoreVCSAndIgnoreFile checks that -ignore-vcs prunes VCS
+// directories and honors a .renamerignore file in target-dir
+func TestWalkTreeIgnoreVCSAndIgnoreFile(t *testing.T) {
+	defer resetGlobals(t)()
+
+	for _, f := range []string{
+		"/root/keep.txt",
+		"/root/.git/HEAD",
+		"/root/build/out.txt",
+	} {
+		if err := afero.WriteFile(appFs, f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := afero.WriteFile(appFs, "/root/.renamerignore", []byte("build/**\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	excludePatterns := loadIgnoreFile("/root")
+	excludes, err := compileGlobPatterns(excludePatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := walkTree("/root", nil, excludes, true, true)
+	for _, f := range got {
+		if filepath.Base(filepath.Dir(f)) == ".git" {
+			t.Errorf("walkTree should have pruned .git, got %s", f)
+		}
+		if f == "/root/build/out.txt" {
+			t.Error("walkTree should have honored .renamerignore and pruned build/")
+		}
+	}
+	found := false
+	for _, f := range got {
+		if f == "/root/keep.txt" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected /root/keep.txt to survive the walk")
+	}
+}